@@ -0,0 +1,108 @@
+package v1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// +genclient
+// +genclient:nonNamespaced
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+
+// MachineConfigRebootPolicy lists files and systemd units whose changes the
+// MCD may apply to a node without a reboot, and how to apply them. The
+// daemon watches these cluster-scoped objects and rebuilds its in-memory
+// AvoidRebootConfig whenever one changes.
+type MachineConfigRebootPolicy struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec MachineConfigRebootPolicySpec `json:"spec"`
+}
+
+// MachineConfigRebootPolicySpec is the desired state of a
+// MachineConfigRebootPolicy.
+type MachineConfigRebootPolicySpec struct {
+	// Files lists file selectors and the action to run when a matching
+	// file's contents change.
+	Files []FileRebootPolicyEntry `json:"files,omitempty"`
+	// Units lists systemd units that can be restarted or reloaded in place
+	// of a reboot when their unit file changes.
+	Units []UnitRebootPolicyEntry `json:"units,omitempty"`
+}
+
+// SelectorType picks how a FileSelector's Pattern is interpreted.
+type SelectorType string
+
+const (
+	// SelectorGlob matches Pattern against the file path with filepath.Match.
+	SelectorGlob SelectorType = "Glob"
+	// SelectorPrefix matches file paths that start with Pattern.
+	SelectorPrefix SelectorType = "Prefix"
+	// SelectorSuffix matches file paths that end with Pattern.
+	SelectorSuffix SelectorType = "Suffix"
+	// SelectorRegex matches file paths against the regular expression in Pattern.
+	SelectorRegex SelectorType = "Regex"
+	// SelectorDirectory matches any file path rooted under the directory tree
+	// named by Pattern.
+	SelectorDirectory SelectorType = "Directory"
+)
+
+// FileSelector matches a file path using one of several schemes, because
+// kubelet configs, CNI configs, and certificate bundles all live in trees
+// that a single filepath.Match glob can't express cleanly.
+type FileSelector struct {
+	Type    SelectorType `json:"type"`
+	Pattern string       `json:"pattern"`
+}
+
+// FileRebootPolicyEntry maps a set of files to the action that should run
+// when one of them changes.
+type FileRebootPolicyEntry struct {
+	Selector       FileSelector         `json:"selector"`
+	Action         PostUpdateActionSpec `json:"action"`
+	TimeoutSeconds int64                `json:"timeoutSeconds,omitempty"`
+	DrainRequired  bool                 `json:"drainRequired,omitempty"`
+}
+
+// UnitRebootPolicyEntry names a systemd unit that can be restarted in place
+// of a reboot when its unit file changes.
+type UnitRebootPolicyEntry struct {
+	Name string `json:"name"`
+	// DependentUnits are additional units to restart transitively alongside
+	// Name, e.g. restarting crio.service may also need to bounce
+	// kubelet.service. Each is only acted on once the daemon confirms,
+	// via the unit's Wants/Requires, that it actually depends on Name.
+	DependentUnits []string `json:"dependentUnits,omitempty"`
+	TimeoutSeconds int64    `json:"timeoutSeconds,omitempty"`
+	DrainRequired  bool     `json:"drainRequired,omitempty"`
+}
+
+// PostUpdateActionSpec configures the action run after a matched file or
+// unit changes. Exactly one of Binary or Systemctl should be set.
+type PostUpdateActionSpec struct {
+	Binary    *BinaryActionSpec    `json:"binary,omitempty"`
+	Systemctl *SystemctlActionSpec `json:"systemctl,omitempty"`
+}
+
+// BinaryActionSpec runs an arbitrary command.
+type BinaryActionSpec struct {
+	Command string   `json:"command"`
+	Args    []string `json:"args,omitempty"`
+}
+
+// SystemctlActionSpec restarts or reloads a systemd unit.
+type SystemctlActionSpec struct {
+	Unit string `json:"unit"`
+	// Operation is "restart" or "reload".
+	Operation string `json:"operation"`
+}
+
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+
+// MachineConfigRebootPolicyList is a list of MachineConfigRebootPolicy.
+type MachineConfigRebootPolicyList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+
+	Items []MachineConfigRebootPolicy `json:"items"`
+}
@@ -0,0 +1,120 @@
+package daemon
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	igntypes "github.com/coreos/ignition/config/v2_2/types"
+	"github.com/google/uuid"
+	"github.com/vincent-petithory/dataurl"
+)
+
+const (
+	defaultFileMode  = os.FileMode(0644)
+	tmpFileSuffix    = "mco-tmp-"
+	backupFileSuffix = "mco-bak-"
+)
+
+// decodeFileContents decodes the data URL carried by an ignition file into
+// the raw bytes that should end up on disk.
+func decodeFileContents(file igntypes.File) ([]byte, error) {
+	if file.Contents.Source == "" {
+		return []byte{}, nil
+	}
+	decoded, err := dataurl.DecodeString(file.Contents.Source)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode contents of %q: %v", file.Path, err)
+	}
+	return decoded.Data, nil
+}
+
+// fsyncPath opens path and fsyncs it. It works for both regular files and
+// directories, which is what lets it be used to make a rename durable.
+func fsyncPath(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open %q for fsync: %v", path, err)
+	}
+	defer f.Close()
+	if err := f.Sync(); err != nil {
+		return fmt.Errorf("failed to fsync %q: %v", path, err)
+	}
+	return nil
+}
+
+// writeFileAtomic writes file's decoded contents to disk without ever
+// leaving file.Path in a half-written state: the new contents land in a temp
+// file in the same directory, get fsynced, and are then renamed over
+// file.Path, after which the parent directory is fsynced so the rename
+// itself survives a crash.
+func writeFileAtomic(file igntypes.File) error {
+	mode := defaultFileMode
+	if file.Mode != nil {
+		mode = os.FileMode(*file.Mode)
+	}
+	contents, err := decodeFileContents(file)
+	if err != nil {
+		return err
+	}
+
+	dir := filepath.Dir(file.Path)
+	tmpPath := fmt.Sprintf("%s.%s%s", file.Path, tmpFileSuffix, uuid.New().String())
+	if err := ioutil.WriteFile(tmpPath, contents, mode); err != nil {
+		return fmt.Errorf("failed to write temp file %q: %v", tmpPath, err)
+	}
+	if err := fsyncPath(tmpPath); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := os.Rename(tmpPath, file.Path); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to rename %q into place at %q: %v", tmpPath, file.Path, err)
+	}
+	return fsyncPath(dir)
+}
+
+// writeUnitFileAtomic writes unit's contents to systemdUnitPath(unit.Name)
+// using the same temp-file+fsync+rename idiom as writeFileAtomic, so that a
+// unit update is as crash-safe as a file update.
+func writeUnitFileAtomic(unit *igntypes.Unit) error {
+	contents := unit.Contents
+
+	path := systemdUnitPath(unit.Name)
+	dir := filepath.Dir(path)
+	tmpPath := fmt.Sprintf("%s.%s%s", path, tmpFileSuffix, uuid.New().String())
+	if err := ioutil.WriteFile(tmpPath, []byte(contents), defaultFileMode); err != nil {
+		return fmt.Errorf("failed to write temp unit file %q: %v", tmpPath, err)
+	}
+	if err := fsyncPath(tmpPath); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to rename %q into place at %q: %v", tmpPath, path, err)
+	}
+	return fsyncPath(dir)
+}
+
+// backupExistingFile moves path out of the way to a sibling backup path
+// before it is overwritten or removed, so that a ChangeJournal can put it
+// back if a later step in the update fails. It is a no-op, returning an
+// empty backup path, if path doesn't currently exist.
+func backupExistingFile(path string) (string, error) {
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return "", nil
+	} else if err != nil {
+		return "", fmt.Errorf("failed to stat %q: %v", path, err)
+	}
+
+	backupPath := fmt.Sprintf("%s.%s%s", path, backupFileSuffix, uuid.New().String())
+	if err := os.Rename(path, backupPath); err != nil {
+		return "", fmt.Errorf("failed to back up %q to %q: %v", path, backupPath, err)
+	}
+	if err := fsyncPath(filepath.Dir(path)); err != nil {
+		return "", err
+	}
+	return backupPath, nil
+}
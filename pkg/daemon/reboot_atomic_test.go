@@ -0,0 +1,142 @@
+package daemon
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	igntypes "github.com/coreos/ignition/config/v2_2/types"
+	"github.com/vincent-petithory/dataurl"
+)
+
+func ignFile(path, contents string) igntypes.File {
+	mode := 0644
+	source := dataurl.New([]byte(contents), "text/plain").String()
+	return igntypes.File{
+		Node: igntypes.Node{Path: path},
+		FileEmbedded1: igntypes.FileEmbedded1{
+			Contents: igntypes.FileContents{Source: source},
+			Mode:     &mode,
+		},
+	}
+}
+
+func TestWriteFileAtomicCreatesFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "reboot-atomic-test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	target := filepath.Join(dir, "config.conf")
+	if err := writeFileAtomic(ignFile(target, "hello")); err != nil {
+		t.Fatalf("writeFileAtomic() returned error: %v", err)
+	}
+
+	got, err := ioutil.ReadFile(target)
+	if err != nil {
+		t.Fatalf("failed to read written file: %v", err)
+	}
+	if string(got) != "hello" {
+		t.Errorf("got contents %q, want %q", got, "hello")
+	}
+
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("failed to list dir: %v", err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("expected only the final file to remain in %q, found %d entries", dir, len(entries))
+	}
+}
+
+// TestWriteFileAtomicInterruptedRenameLeavesOriginalIntact exercises the
+// failure path a crash mid-rename would otherwise leave impossible to
+// reason about: if the rename step can't land (here forced by making the
+// rename target a directory instead of actually killing the process
+// mid-syscall), the original content at target must survive untouched and
+// no temp file should be left behind.
+func TestWriteFileAtomicInterruptedRenameLeavesOriginalIntact(t *testing.T) {
+	dir, err := ioutil.TempDir("", "reboot-atomic-test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	target := filepath.Join(dir, "config.conf")
+	if err := os.Mkdir(target, 0755); err != nil {
+		t.Fatalf("failed to create blocking directory: %v", err)
+	}
+
+	if err := writeFileAtomic(ignFile(target, "replacement")); err == nil {
+		t.Fatal("expected writeFileAtomic to fail when the rename target is a directory")
+	}
+
+	info, err := os.Stat(target)
+	if err != nil {
+		t.Fatalf("target disappeared after failed write: %v", err)
+	}
+	if !info.IsDir() {
+		t.Error("expected the original directory to be left in place after an interrupted rename")
+	}
+
+	matches, err := filepath.Glob(target + ".mco-tmp-*")
+	if err != nil {
+		t.Fatalf("failed to glob for leftover temp files: %v", err)
+	}
+	if len(matches) != 0 {
+		t.Errorf("expected the temp file to be cleaned up, found %v", matches)
+	}
+}
+
+func TestBackupExistingFileRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "reboot-atomic-test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	target := filepath.Join(dir, "unit.conf")
+	if err := ioutil.WriteFile(target, []byte("original"), 0644); err != nil {
+		t.Fatalf("failed to seed file: %v", err)
+	}
+
+	backup, err := backupExistingFile(target)
+	if err != nil {
+		t.Fatalf("backupExistingFile() returned error: %v", err)
+	}
+	if backup == "" {
+		t.Fatal("expected a non-empty backup path for an existing file")
+	}
+	if _, err := os.Stat(target); !os.IsNotExist(err) {
+		t.Fatalf("expected target to be moved aside, stat err: %v", err)
+	}
+
+	if err := os.Rename(backup, target); err != nil {
+		t.Fatalf("failed to restore from backup: %v", err)
+	}
+	got, err := ioutil.ReadFile(target)
+	if err != nil {
+		t.Fatalf("failed to read restored file: %v", err)
+	}
+	if string(got) != "original" {
+		t.Errorf("got contents %q after restore, want %q", got, "original")
+	}
+}
+
+func TestBackupExistingFileMissingFileIsNoop(t *testing.T) {
+	dir, err := ioutil.TempDir("", "reboot-atomic-test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	backup, err := backupExistingFile(filepath.Join(dir, "does-not-exist"))
+	if err != nil {
+		t.Fatalf("backupExistingFile() returned error for a missing file: %v", err)
+	}
+	if backup != "" {
+		t.Errorf("expected an empty backup path for a missing file, got %q", backup)
+	}
+}
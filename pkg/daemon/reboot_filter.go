@@ -1,10 +1,14 @@
 package daemon
 
 import (
+	"context"
 	"fmt"
+	"os"
 	"os/exec"
-	"path/filepath"
 	"reflect"
+	"sync"
+	"syscall"
+	"time"
 
 	igntypes "github.com/coreos/ignition/config/v2_2/types"
 	"github.com/deckarep/golang-set"
@@ -12,13 +16,24 @@ import (
 )
 
 type FileFilterEntry struct {
-	glob             string
+	matcher          *fileMatcher
 	postUpdateAction PostUpdateAction
+	// timeout overrides the post update action's own timeout, if any.
+	// Zero means use whatever the action was configured with.
+	timeout time.Duration
 }
 
 type UnitFilterEntry struct {
 	name          string
 	drainRequired bool
+	// dependentUnits are additional units that should be restarted
+	// transitively whenever name is, e.g. restarting crio.service should
+	// also bounce kubelet.service. Each entry is only acted on once it is
+	// confirmed, via the unit's Wants/Requires, to actually depend on name.
+	dependentUnits []string
+	// timeout overrides unitJobTimeout for this unit's post update action.
+	// Zero means use the default.
+	timeout time.Duration
 }
 
 type AvoidRebootConfig struct {
@@ -28,10 +43,14 @@ type AvoidRebootConfig struct {
 	Units []*UnitFilterEntry
 }
 
-var filterConfig = AvoidRebootConfig{
+// filterConfig is a thread-safe holder around the default, hardcoded
+// AvoidRebootConfig. It is kept up to date by StartRebootPolicyWatch, which
+// rebuilds and swaps in a new AvoidRebootConfig derived from
+// MachineConfigRebootPolicy objects whenever one changes.
+var filterConfig = newPolicyHolder(AvoidRebootConfig{
 	Files: []*FileFilterEntry{
 		// &FileFilterEntry{
-		// 	glob: "/etc/kubernetes/kubelet.conf",
+		// 	matcher: globMatcher("/etc/kubernetes/kubelet.conf"),
 		// 	postUpdateAction: RunSystemctlAction{
 		// 		unitName:  "kubelet.service",
 		// 		operation: unitReload,
@@ -39,7 +58,7 @@ var filterConfig = AvoidRebootConfig{
 		// 	drainRequired: true,
 		// },
 		&FileFilterEntry{
-			glob: "/home/core/testfile",
+			matcher: globMatcher("/home/core/testfile"),
 			postUpdateAction: RunBinaryAction{
 				binary: "/bin/bash",
 				args: []string{
@@ -56,17 +75,17 @@ var filterConfig = AvoidRebootConfig{
 			drainRequired: false,
 		},
 	},
-}
+})
 
 func (config AvoidRebootConfig) getFileAction(filePath string) PostUpdateAction {
 	for _, entry := range config.Files {
-		matched, err := filepath.Match(entry.glob, filePath)
+		matched, err := entry.matcher.matches(filePath)
 		if err != nil {
-			// TODO: log
+			glog.Warningf("Failed to match file selector against %q: %v", filePath, err)
 			continue
 		}
 		if matched {
-			return entry.postUpdateAction
+			return withTimeout(entry.postUpdateAction, entry.timeout)
 		}
 	}
 	return nil
@@ -75,21 +94,55 @@ func (config AvoidRebootConfig) getFileAction(filePath string) PostUpdateAction
 func (config AvoidRebootConfig) getUnitAction(unitName string) PostUpdateAction {
 	for _, entry := range config.Units {
 		if entry.name == unitName {
-			return RunSystemctlAction{
-				unitName,
-				unitRestart,
-				DrainRequired{drainRequired: entry.drainRequired},
+			return &RunSystemctlAction{
+				unitName:       unitName,
+				operation:      unitRestart,
+				dependentUnits: entry.dependentUnits,
+				DrainRequired:  DrainRequired{drainRequired: entry.drainRequired},
+				timeout:        entry.timeout,
 			}
 		}
 	}
 	return nil
 }
 
+// withTimeout returns a copy of action with its timeout overridden, unless
+// timeout is zero, in which case action is returned unchanged.
+func withTimeout(action PostUpdateAction, timeout time.Duration) PostUpdateAction {
+	if timeout <= 0 {
+		return action
+	}
+	switch a := action.(type) {
+	case RunBinaryAction:
+		a.timeout = timeout
+		return a
+	case *RunSystemctlAction:
+		clone := *a
+		clone.timeout = timeout
+		return &clone
+	default:
+		return action
+	}
+}
+
+// ActionResult carries everything about how a PostUpdateAction ran that the
+// controller needs in order to record it on the MachineConfigDaemon status
+// and as a Kubernetes event, instead of it only ever being glog'd.
+type ActionResult struct {
+	Stdout        string
+	Stderr        string
+	ExitCode      int
+	Duration      time.Duration
+	UnitJobStatus string
+}
+
 type PostUpdateAction interface {
-	Run() error
+	Run(ctx context.Context) (ActionResult, error)
 	getIsDrainRequired() bool
-	// TODO: add dbus connection setup
-	// SetDbusConnection()
+	// SetDbusConnection wires in the systemd dbus connection shared by all
+	// actions in a single update pass. Actions that don't talk to systemd
+	// can just no-op it.
+	SetDbusConnection(conn *dbusConnection)
 }
 
 type DrainRequired struct {
@@ -105,19 +158,101 @@ type RunBinaryAction struct {
 	args   []string
 	// IsDrainRequired bool
 	DrainRequired
+	// timeout bounds how long the binary may run before Run kills it with
+	// SIGKILL once its context is done. Zero means no bound beyond whatever
+	// the caller's context already carries.
+	timeout time.Duration
 }
 
-func (action RunBinaryAction) Run() error {
+func (action RunBinaryAction) SetDbusConnection(conn *dbusConnection) {}
+
+// Run starts action's binary and streams its stdout/stderr line by line into
+// glog as it runs, rather than buffering it all in memory, so that
+// long-running reload hooks (e.g. regenerating CNI state) stay observable.
+// The child's exit status comes from the package-wide childReaper rather
+// than exec.Cmd.Wait, since on a system where the MCD runs as PID 1 a
+// competing SIGCHLD-driven reap of orphaned grandchildren must not race
+// Wait's own wait4 call for this specific child.
+func (action RunBinaryAction) Run(ctx context.Context) (ActionResult, error) {
+	if action.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, action.timeout)
+		defer cancel()
+	}
+
 	glog.Infof(
 		"Running post update action: running command: %v %v", action.binary, action.args,
 	)
-	output, err := exec.Command(action.binary, action.args...).CombinedOutput()
-	// TODO: Add some timeout?
+	cmd := exec.Command(action.binary, action.args...)
+	stdout, err := cmd.StdoutPipe()
 	if err != nil {
-		glog.Errorf("Running post update action (running command: '%s %s') failed: %s; command output: %s", action.binary, action.args, err, output)
-		return err
+		return ActionResult{}, fmt.Errorf("failed to open stdout pipe for %q: %v", action.binary, err)
 	}
-	return nil
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return ActionResult{}, fmt.Errorf("failed to open stderr pipe for %q: %v", action.binary, err)
+	}
+
+	start := time.Now()
+	statusCh, err := reaper.start(cmd)
+	if err != nil {
+		return ActionResult{}, fmt.Errorf("failed to start %q: %v", action.binary, err)
+	}
+	defer reaper.stopWaiting(cmd.Process.Pid)
+
+	// Kill the process as soon as ctx is done, rather than only after its
+	// output streams close, so a per-action timeout takes effect promptly
+	// even against a command that never stops producing output.
+	finished := make(chan struct{})
+	defer close(finished)
+	go func() {
+		select {
+		case <-ctx.Done():
+			cmd.Process.Kill()
+		case <-finished:
+		}
+	}()
+
+	outBuf := lineCapBuffer{limit: maxCapturedOutputBytes}
+	errBuf := lineCapBuffer{limit: maxCapturedOutputBytes}
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go streamOutput(&wg, stdout, &outBuf, "stdout", action.binary)
+	go streamOutput(&wg, stderr, &errBuf, "stderr", action.binary)
+	wg.Wait()
+
+	// cmd.Wait is deliberately never called (the childReaper owns reaping
+	// this PID instead), so nothing else closes these pipes' read ends; do
+	// it ourselves now that the scanners above have already hit EOF on them.
+	stdout.Close()
+	stderr.Close()
+
+	result := ActionResult{ExitCode: exitCodeFromWaitStatus(<-statusCh)}
+	result.Stdout = outBuf.String()
+	result.Stderr = errBuf.String()
+	result.Duration = time.Since(start)
+
+	if ctx.Err() != nil {
+		err = fmt.Errorf("command %q timed out after %s: %v", action.binary, action.timeout, ctx.Err())
+	}
+	if err == nil && result.ExitCode != 0 {
+		err = fmt.Errorf("command %q exited with status %d", action.binary, result.ExitCode)
+	}
+	if err != nil {
+		glog.Errorf("Running post update action (running command: '%s %s') failed: %s; stdout: %s; stderr: %s", action.binary, action.args, err, result.Stdout, result.Stderr)
+		return result, err
+	}
+	return result, nil
+}
+
+// exitCodeFromWaitStatus maps a reaped wait status onto the exit code
+// carried by ActionResult: a non-negative process exit code, or the
+// negated terminating signal number if the process was killed by one.
+func exitCodeFromWaitStatus(ws syscall.WaitStatus) int {
+	if ws.Signaled() {
+		return -int(ws.Signal())
+	}
+	return ws.ExitStatus()
 }
 
 type UnitOperation string
@@ -130,19 +265,16 @@ const (
 type RunSystemctlAction struct {
 	unitName  string
 	operation UnitOperation
+	// dependentUnits are candidate unit names to also restart/reload
+	// transitively; see resolveDependents for how they're confirmed.
+	dependentUnits []string
 	DrainRequired
-	// TODO: add systemd dbus connection
-}
-
-func (action RunSystemctlAction) Run() error {
-	glog.Warningf(
-		"Systemd post update action not implemented! Unit: %s; Operation: %s",
-		action.unitName,
-		action.operation,
-	)
-	// TODO: implement
-	// https://godoc.org/github.com/coreos/go-systemd/dbus
-	return nil
+	// dbus is the connection shared across all actions in a single update
+	// pass, set via SetDbusConnection before Run is called.
+	dbus *dbusConnection
+	// timeout overrides unitJobTimeout for this action's systemd job wait.
+	// Zero means use the default.
+	timeout time.Duration
 }
 
 type ChangeType string
@@ -209,15 +341,36 @@ func getFilesChanges(oldFilesConfig, newFilesConfig []igntypes.File) []*FileChan
 	return changes
 }
 
-func handleFilesChanges(changes []*FileChange) (err error) {
+// handleFilesChanges applies changes to disk using a temp-file-plus-rename
+// idiom so that a crash mid-write never leaves a target file partially
+// written. Any existing file a change replaces or removes is moved aside to
+// a backup path rather than destroyed outright, and every change applied is
+// recorded on journal so that, if a later step in the update fails, it can
+// all be undone with journal.Undo().
+func handleFilesChanges(changes []*FileChange, journal *ChangeJournal) (err error) {
 	for _, change := range changes {
 		switch change.changeType {
 		case changeCreated:
-			fallthrough
+			if err = writeFileAtomic(change.file); err == nil {
+				journal.recordCreatedFile(change.name)
+			}
 		case changeUpdated:
-			err = writeFile(change.file)
+			var backup string
+			if backup, err = backupExistingFile(change.name); err != nil {
+				return
+			}
+			if err = writeFileAtomic(change.file); err != nil {
+				if backup != "" {
+					os.Rename(backup, change.name)
+				}
+				return
+			}
+			journal.recordReplacedFile(change.name, backup)
 		case changeDeleted:
-			err = deleteFile(change.name)
+			var backup string
+			if backup, err = backupExistingFile(change.name); err == nil {
+				journal.recordDeletedFile(change.name, backup)
+			}
 		default:
 			err = fmt.Errorf("Unknown change type %q", change.changeType)
 		}
@@ -289,20 +442,40 @@ func getUnitsChanges(oldUnitsConfig, newUnitsConfig []igntypes.Unit) []*UnitChan
 	return changes
 }
 
-func handleUnitsChanges(changes []*UnitChange) (err error) {
+// handleUnitsChanges applies changes to systemd unit files and records every
+// change applied on journal so that, if a later step in the update fails, it
+// can all be undone with journal.Undo(). An updated unit is written with the
+// same shadow-path-then-rename idiom handleFilesChanges uses for files
+// (backupExistingFile + writeUnitFileAtomic, recorded as a replaced file on
+// the journal) rather than a raw delete-then-create, so the unit file is
+// never left partially written. A crash between moving the old unit file to
+// its backup path and renaming the new one into place leaves no file at the
+// unit path, with the old contents still at the backup path; the journal
+// lives only in memory, so it does not survive such a crash.
+func handleUnitsChanges(changes []*UnitChange, journal *ChangeJournal) (err error) {
 	for _, change := range changes {
 		switch change.changeType {
 		case changeCreated:
-			err = createUnit(change.newUnit)
+			if err = createUnit(change.newUnit); err == nil {
+				journal.recordCreatedUnit(change.newUnit)
+			}
 		case changeUpdated:
-			err = deleteUnit(change.oldUnit)
-			if err != nil {
-				// TODO: try to write it back or do it in roll-back?
+			unitPath := systemdUnitPath(change.name)
+			var backup string
+			if backup, err = backupExistingFile(unitPath); err != nil {
+				return
+			}
+			if err = writeUnitFileAtomic(change.newUnit); err != nil {
+				if backup != "" {
+					os.Rename(backup, unitPath)
+				}
 				return
 			}
-			err = createUnit(change.newUnit)
+			journal.recordReplacedFile(unitPath, backup)
 		case changeDeleted:
-			err = deleteUnit(change.oldUnit)
+			if err = deleteUnit(change.oldUnit); err == nil {
+				journal.recordDeletedUnit(change.oldUnit)
+			}
 		default:
 			err = nil
 		}
@@ -359,6 +532,21 @@ func getPostUpdateActions(filesChanges []*FileChange, unitsChanges []*UnitChange
 	return actions, nil
 }
 
+// actionsNeedUnitReload reports whether actions contains at least one
+// RunSystemctlAction, i.e. whether this batch touches a systemd unit at all.
+// A daemon-reload is only meaningful (and only worth requiring a working
+// systemd dbus connection for) when it is: a batch of pure file changes
+// handled entirely by RunBinaryAction shouldn't start failing because of an
+// unrelated dbus hiccup.
+func actionsNeedUnitReload(actions []PostUpdateAction) bool {
+	for _, action := range actions {
+		if _, ok := action.(*RunSystemctlAction); ok {
+			return true
+		}
+	}
+	return false
+}
+
 func isDrainRequired(actions []PostUpdateAction) bool {
 	isRequired := false
 	for _, action := range actions {
@@ -367,14 +555,76 @@ func isDrainRequired(actions []PostUpdateAction) bool {
 	return isRequired
 }
 
-func runPostUpdateActions(actions []PostUpdateAction) bool {
+// runPostUpdateActions runs actions in order, stopping at the first failure.
+// ctx comes from the MCD's main update loop; cancelling it (e.g. on
+// shutdown) aborts whichever action is currently running. It returns the
+// ActionResult of every action that was started, so callers can surface them
+// on the MachineConfigDaemon status and as Kubernetes events.
+func runPostUpdateActions(ctx context.Context, actions []PostUpdateAction) ([]ActionResult, bool) {
 	glog.Infof("Running %d post update action(s)...", len(actions))
+	results := make([]ActionResult, 0, len(actions))
+
+	dbusConn := &dbusConnection{}
+	defer dbusConn.close()
+	if actionsNeedUnitReload(actions) {
+		if err := dbusConn.reloadDaemon(); err != nil {
+			glog.Errorf("Post update action failed: %s", err)
+			return results, true
+		}
+	}
+
 	for _, action := range actions {
-		if err := action.Run(); err != nil {
+		action.SetDbusConnection(dbusConn)
+		result, err := action.Run(ctx)
+		results = append(results, result)
+		if err != nil {
 			glog.Errorf("Post update action failed: %s", err)
-			return true
+			return results, true
 		}
 	}
 	glog.Info("Running post update Actions were sucessfull")
-	return false
+	return results, false
+}
+
+// applyNodeChanges applies fileChanges and unitChanges to the node and, once
+// they're in place, runs whatever post update actions they require. Every
+// step is recorded on a single ChangeJournal; if any step fails, everything
+// recorded so far is undone so the node ends up fully back on the previous
+// MachineConfig rather than stuck half migrated. ctx bounds how long the
+// post update actions are allowed to run.
+func applyNodeChanges(ctx context.Context, fileChanges []*FileChange, unitChanges []*UnitChange) ([]ActionResult, error) {
+	journal := &ChangeJournal{}
+
+	if err := handleFilesChanges(fileChanges, journal); err != nil {
+		if undoErr := journal.Undo(); undoErr != nil {
+			glog.Errorf("Failed to roll back after file changes failed: %v", undoErr)
+		}
+		return nil, fmt.Errorf("failed to apply file changes: %v", err)
+	}
+
+	if err := handleUnitsChanges(unitChanges, journal); err != nil {
+		if undoErr := journal.Undo(); undoErr != nil {
+			glog.Errorf("Failed to roll back after unit changes failed: %v", undoErr)
+		}
+		return nil, fmt.Errorf("failed to apply unit changes: %v", err)
+	}
+
+	actions, err := getPostUpdateActions(fileChanges, unitChanges)
+	if err != nil {
+		if undoErr := journal.Undo(); undoErr != nil {
+			glog.Errorf("Failed to roll back after resolving post update actions failed: %v", undoErr)
+		}
+		return nil, err
+	}
+
+	results, failed := runPostUpdateActions(ctx, actions)
+	if failed {
+		if undoErr := journal.Undo(); undoErr != nil {
+			glog.Errorf("Failed to roll back after post update actions failed: %v", undoErr)
+		}
+		return results, fmt.Errorf("post update actions failed")
+	}
+
+	journal.Commit()
+	return results, nil
 }
@@ -0,0 +1,158 @@
+package daemon
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	igntypes "github.com/coreos/ignition/config/v2_2/types"
+	"github.com/golang/glog"
+)
+
+// journalOp is one reversible step recorded by a ChangeJournal. undo
+// restores the state the op replaced; commit discards whatever undo would
+// have needed (e.g. a backup file that's no longer wanted once the whole
+// batch has succeeded).
+type journalOp interface {
+	undo() error
+	commit()
+}
+
+type createdFileOp struct {
+	path string
+}
+
+func (o createdFileOp) undo() error {
+	if err := os.Remove(o.path); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove created file %q: %v", o.path, err)
+	}
+	return nil
+}
+
+func (o createdFileOp) commit() {}
+
+type replacedFileOp struct {
+	path   string
+	backup string
+}
+
+func (o replacedFileOp) undo() error {
+	if o.backup == "" {
+		// Nothing existed at path before it was written, so undoing the
+		// write means removing it.
+		if err := os.Remove(o.path); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove %q: %v", o.path, err)
+		}
+		return nil
+	}
+	if err := os.Rename(o.backup, o.path); err != nil {
+		return fmt.Errorf("failed to restore %q from backup %q: %v", o.path, o.backup, err)
+	}
+	return nil
+}
+
+func (o replacedFileOp) commit() {
+	if err := os.Remove(o.backup); err != nil && !os.IsNotExist(err) {
+		glog.Warningf("Failed to remove backup %q for %q: %v", o.backup, o.path, err)
+	}
+}
+
+type deletedFileOp struct {
+	path   string
+	backup string
+}
+
+func (o deletedFileOp) undo() error {
+	if o.backup == "" {
+		return nil
+	}
+	if err := os.Rename(o.backup, o.path); err != nil {
+		return fmt.Errorf("failed to restore deleted file %q from backup %q: %v", o.path, o.backup, err)
+	}
+	return nil
+}
+
+func (o deletedFileOp) commit() {
+	if o.backup == "" {
+		return
+	}
+	if err := os.Remove(o.backup); err != nil && !os.IsNotExist(err) {
+		glog.Warningf("Failed to remove backup %q for deleted file %q: %v", o.backup, o.path, err)
+	}
+}
+
+type createdUnitOp struct {
+	unit *igntypes.Unit
+}
+
+func (o createdUnitOp) undo() error {
+	return deleteUnit(o.unit)
+}
+
+func (o createdUnitOp) commit() {}
+
+type deletedUnitOp struct {
+	unit *igntypes.Unit
+}
+
+func (o deletedUnitOp) undo() error {
+	return createUnit(o.unit)
+}
+
+func (o deletedUnitOp) commit() {}
+
+// ChangeJournal records, in order, every reversible operation performed
+// while applying file and unit changes for a single MachineConfig update. If
+// a later step in the update fails, Undo walks the journal backwards and
+// restores everything it recorded, so the node ends up fully back on the
+// previous MachineConfig instead of stuck half migrated, without needing a
+// reboot to recover. If every step succeeds, Commit discards whatever state
+// Undo would have needed.
+type ChangeJournal struct {
+	ops []journalOp
+}
+
+func (j *ChangeJournal) recordCreatedFile(path string) {
+	j.ops = append(j.ops, createdFileOp{path: path})
+}
+
+func (j *ChangeJournal) recordReplacedFile(path, backup string) {
+	j.ops = append(j.ops, replacedFileOp{path: path, backup: backup})
+}
+
+func (j *ChangeJournal) recordDeletedFile(path, backup string) {
+	j.ops = append(j.ops, deletedFileOp{path: path, backup: backup})
+}
+
+func (j *ChangeJournal) recordCreatedUnit(unit *igntypes.Unit) {
+	j.ops = append(j.ops, createdUnitOp{unit: unit})
+}
+
+func (j *ChangeJournal) recordDeletedUnit(unit *igntypes.Unit) {
+	j.ops = append(j.ops, deletedUnitOp{unit: unit})
+}
+
+// Undo reverses every recorded operation, most recently recorded first. It
+// is best-effort: a failure undoing one op doesn't stop it from attempting
+// the rest, so it restores as much as it can before returning a combined
+// error describing whatever it couldn't.
+func (j *ChangeJournal) Undo() error {
+	var errs []string
+	for i := len(j.ops) - 1; i >= 0; i-- {
+		if err := j.ops[i].undo(); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("rollback encountered errors: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// Commit discards the backups kept around purely to support Undo, now that
+// the whole batch they belong to has succeeded.
+func (j *ChangeJournal) Commit() {
+	for _, op := range j.ops {
+		op.commit()
+	}
+}
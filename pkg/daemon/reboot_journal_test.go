@@ -0,0 +1,149 @@
+package daemon
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestChangeJournalUndoRestoresPartialBatch simulates the scenario
+// handleFilesChanges/handleUnitsChanges leave applyNodeChanges to recover
+// from: a batch where a create, a replace, and a delete have already landed
+// on disk and been recorded, and a later, unrelated step then fails. Undo
+// must put every one of them back.
+func TestChangeJournalUndoRestoresPartialBatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "reboot-journal-test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	createdPath := filepath.Join(dir, "created.conf")
+	replacedPath := filepath.Join(dir, "replaced.conf")
+	deletedPath := filepath.Join(dir, "deleted.conf")
+
+	if err := ioutil.WriteFile(replacedPath, []byte("old contents"), 0644); err != nil {
+		t.Fatalf("failed to seed replaced file: %v", err)
+	}
+	if err := ioutil.WriteFile(deletedPath, []byte("to be deleted"), 0644); err != nil {
+		t.Fatalf("failed to seed deleted file: %v", err)
+	}
+
+	journal := &ChangeJournal{}
+
+	if err := ioutil.WriteFile(createdPath, []byte("new file"), 0644); err != nil {
+		t.Fatalf("failed to write created file: %v", err)
+	}
+	journal.recordCreatedFile(createdPath)
+
+	replaceBackup, err := backupExistingFile(replacedPath)
+	if err != nil {
+		t.Fatalf("backupExistingFile() returned error: %v", err)
+	}
+	if err := ioutil.WriteFile(replacedPath, []byte("new contents"), 0644); err != nil {
+		t.Fatalf("failed to write replacement contents: %v", err)
+	}
+	journal.recordReplacedFile(replacedPath, replaceBackup)
+
+	deleteBackup, err := backupExistingFile(deletedPath)
+	if err != nil {
+		t.Fatalf("backupExistingFile() returned error: %v", err)
+	}
+	journal.recordDeletedFile(deletedPath, deleteBackup)
+
+	// A later step in the update now fails; everything recorded above must
+	// be undone.
+	if err := journal.Undo(); err != nil {
+		t.Fatalf("Undo() returned error: %v", err)
+	}
+
+	if _, err := os.Stat(createdPath); !os.IsNotExist(err) {
+		t.Errorf("expected created file to be removed by Undo, stat err: %v", err)
+	}
+
+	got, err := ioutil.ReadFile(replacedPath)
+	if err != nil {
+		t.Fatalf("failed to read replaced file after Undo: %v", err)
+	}
+	if string(got) != "old contents" {
+		t.Errorf("got contents %q after Undo, want %q", got, "old contents")
+	}
+
+	got, err = ioutil.ReadFile(deletedPath)
+	if err != nil {
+		t.Fatalf("failed to read deleted file after Undo: %v", err)
+	}
+	if string(got) != "to be deleted" {
+		t.Errorf("got contents %q after Undo, want %q", got, "to be deleted")
+	}
+}
+
+func TestChangeJournalCommitDiscardsBackups(t *testing.T) {
+	dir, err := ioutil.TempDir("", "reboot-journal-test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "replaced.conf")
+	if err := ioutil.WriteFile(path, []byte("old"), 0644); err != nil {
+		t.Fatalf("failed to seed file: %v", err)
+	}
+
+	backup, err := backupExistingFile(path)
+	if err != nil {
+		t.Fatalf("backupExistingFile() returned error: %v", err)
+	}
+	if err := ioutil.WriteFile(path, []byte("new"), 0644); err != nil {
+		t.Fatalf("failed to write replacement contents: %v", err)
+	}
+
+	journal := &ChangeJournal{}
+	journal.recordReplacedFile(path, backup)
+	journal.Commit()
+
+	if _, err := os.Stat(backup); !os.IsNotExist(err) {
+		t.Errorf("expected backup to be removed by Commit, stat err: %v", err)
+	}
+	got, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read file after Commit: %v", err)
+	}
+	if string(got) != "new" {
+		t.Errorf("got contents %q after Commit, want %q", got, "new")
+	}
+}
+
+// TestChangeJournalUndoIsBestEffort confirms that one op failing to undo
+// (here, its backup has gone missing, representing an interrupted rename
+// that never landed) doesn't stop Undo from restoring the rest of the
+// batch; it must return a combined error instead of bailing out early.
+func TestChangeJournalUndoIsBestEffort(t *testing.T) {
+	dir, err := ioutil.TempDir("", "reboot-journal-test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	createdPath := filepath.Join(dir, "created.conf")
+	if err := ioutil.WriteFile(createdPath, []byte("new file"), 0644); err != nil {
+		t.Fatalf("failed to write created file: %v", err)
+	}
+
+	journal := &ChangeJournal{}
+	journal.recordCreatedFile(createdPath)
+	// This op's backup path was never actually created, simulating a
+	// rename that was interrupted before it could land. It is recorded
+	// last so that Undo, which walks the journal backwards, hits its
+	// failure before it reaches the created file.
+	journal.recordReplacedFile(filepath.Join(dir, "missing.conf"), filepath.Join(dir, "missing.conf.mco-bak-absent"))
+
+	if err := journal.Undo(); err == nil {
+		t.Fatal("expected Undo() to report the failed op")
+	}
+
+	if _, err := os.Stat(createdPath); !os.IsNotExist(err) {
+		t.Errorf("expected created file to still be removed despite the other op failing, stat err: %v", err)
+	}
+}
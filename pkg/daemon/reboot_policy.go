@@ -0,0 +1,220 @@
+package daemon
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	mcfgv1 "github.com/openshift/machine-config-operator/pkg/apis/machineconfiguration.openshift.io/v1"
+	"github.com/golang/glog"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/tools/cache"
+)
+
+// matchKind picks how a fileMatcher's pattern is interpreted.
+type matchKind string
+
+const (
+	matchGlob   matchKind = "glob"
+	matchPrefix matchKind = "prefix"
+	matchSuffix matchKind = "suffix"
+	matchRegex  matchKind = "regex"
+	// matchTree matches any path rooted under pattern, for config trees
+	// (kubelet configs, CNI configs, certificate bundles) that a single
+	// filepath.Match glob can't express cleanly.
+	matchTree matchKind = "tree"
+)
+
+// fileMatcher is a richer alternative to a bare filepath.Match glob.
+type fileMatcher struct {
+	kind    matchKind
+	pattern string
+	re      *regexp.Regexp
+}
+
+func globMatcher(pattern string) *fileMatcher {
+	return &fileMatcher{kind: matchGlob, pattern: pattern}
+}
+
+func (m *fileMatcher) matches(path string) (bool, error) {
+	switch m.kind {
+	case matchPrefix:
+		return strings.HasPrefix(path, m.pattern), nil
+	case matchSuffix:
+		return strings.HasSuffix(path, m.pattern), nil
+	case matchTree:
+		rel, err := filepath.Rel(m.pattern, path)
+		if err != nil {
+			return false, nil
+		}
+		return rel != ".." && !strings.HasPrefix(rel, "../"), nil
+	case matchRegex:
+		if m.re == nil {
+			re, err := regexp.Compile(m.pattern)
+			if err != nil {
+				return false, fmt.Errorf("invalid regex selector %q: %v", m.pattern, err)
+			}
+			m.re = re
+		}
+		return m.re.MatchString(path), nil
+	case matchGlob:
+		fallthrough
+	default:
+		return filepath.Match(m.pattern, path)
+	}
+}
+
+// policyHolder is a thread-safe, swappable AvoidRebootConfig. The daemon
+// watches MachineConfigRebootPolicy objects and calls set whenever they
+// change; getFileAction/getUnitAction always read the latest config.
+type policyHolder struct {
+	mu     sync.RWMutex
+	config AvoidRebootConfig
+}
+
+func newPolicyHolder(initial AvoidRebootConfig) *policyHolder {
+	return &policyHolder{config: initial}
+}
+
+func (h *policyHolder) set(config AvoidRebootConfig) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.config = config
+}
+
+func (h *policyHolder) getFileAction(filePath string) PostUpdateAction {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.config.getFileAction(filePath)
+}
+
+func (h *policyHolder) getUnitAction(unitName string) PostUpdateAction {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.config.getUnitAction(unitName)
+}
+
+// rebootPolicyLister is the subset of the generated
+// MachineConfigRebootPolicyLister that buildAvoidRebootConfig needs.
+type rebootPolicyLister interface {
+	List(selector labels.Selector) ([]*mcfgv1.MachineConfigRebootPolicy, error)
+}
+
+// rebootPolicyInformer is the subset of the generated
+// MachineConfigRebootPolicyInformer we need; see
+// pkg/generated/informers/externalversions for the real implementation
+// produced by `make generate`.
+type rebootPolicyInformer interface {
+	Informer() cache.SharedIndexInformer
+	Lister() rebootPolicyLister
+}
+
+// StartRebootPolicyWatch wires informer events into holder, rebuilding the
+// whole AvoidRebootConfig from every currently known
+// MachineConfigRebootPolicy whenever one is added, updated, or removed. It
+// blocks until the informer's cache has synced for the first time.
+func StartRebootPolicyWatch(informer rebootPolicyInformer, holder *policyHolder, stopCh <-chan struct{}) error {
+	rebuild := func() {
+		policies, err := informer.Lister().List(labels.Everything())
+		if err != nil {
+			glog.Errorf("Failed to list MachineConfigRebootPolicy objects: %v", err)
+			return
+		}
+		config, err := buildAvoidRebootConfig(policies)
+		if err != nil {
+			glog.Errorf("Failed to build reboot policy from %d MachineConfigRebootPolicy object(s): %v", len(policies), err)
+			return
+		}
+		glog.Infof("Rebuilt reboot policy from %d MachineConfigRebootPolicy object(s)", len(policies))
+		holder.set(config)
+	}
+
+	informer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    func(obj interface{}) { rebuild() },
+		UpdateFunc: func(old, new interface{}) { rebuild() },
+		DeleteFunc: func(obj interface{}) { rebuild() },
+	})
+
+	if !cache.WaitForCacheSync(stopCh, informer.Informer().HasSynced) {
+		return fmt.Errorf("timed out waiting for MachineConfigRebootPolicy informer cache to sync")
+	}
+	rebuild()
+	return nil
+}
+
+func buildAvoidRebootConfig(policies []*mcfgv1.MachineConfigRebootPolicy) (AvoidRebootConfig, error) {
+	config := AvoidRebootConfig{}
+	for _, policy := range policies {
+		for _, entry := range policy.Spec.Files {
+			matcher, err := newFileMatcher(entry.Selector)
+			if err != nil {
+				return AvoidRebootConfig{}, fmt.Errorf("policy %q: %v", policy.Name, err)
+			}
+			action, err := buildPostUpdateAction(entry.Action, entry.TimeoutSeconds, entry.DrainRequired)
+			if err != nil {
+				return AvoidRebootConfig{}, fmt.Errorf("policy %q: %v", policy.Name, err)
+			}
+			config.Files = append(config.Files, &FileFilterEntry{
+				matcher:          matcher,
+				postUpdateAction: action,
+			})
+		}
+		for _, entry := range policy.Spec.Units {
+			config.Units = append(config.Units, &UnitFilterEntry{
+				name:           entry.Name,
+				drainRequired:  entry.DrainRequired,
+				dependentUnits: entry.DependentUnits,
+				timeout:        time.Duration(entry.TimeoutSeconds) * time.Second,
+			})
+		}
+	}
+	return config, nil
+}
+
+func newFileMatcher(selector mcfgv1.FileSelector) (*fileMatcher, error) {
+	kinds := map[mcfgv1.SelectorType]matchKind{
+		mcfgv1.SelectorGlob:      matchGlob,
+		mcfgv1.SelectorPrefix:    matchPrefix,
+		mcfgv1.SelectorSuffix:    matchSuffix,
+		mcfgv1.SelectorRegex:     matchRegex,
+		mcfgv1.SelectorDirectory: matchTree,
+	}
+	kind, ok := kinds[selector.Type]
+	if !ok {
+		return nil, fmt.Errorf("unknown file selector type %q", selector.Type)
+	}
+	m := &fileMatcher{kind: kind, pattern: selector.Pattern}
+	if kind == matchRegex {
+		re, err := regexp.Compile(selector.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid regex selector %q: %v", selector.Pattern, err)
+		}
+		m.re = re
+	}
+	return m, nil
+}
+
+func buildPostUpdateAction(spec mcfgv1.PostUpdateActionSpec, timeoutSeconds int64, drainRequired bool) (PostUpdateAction, error) {
+	timeout := time.Duration(timeoutSeconds) * time.Second
+	switch {
+	case spec.Binary != nil:
+		return RunBinaryAction{
+			binary:        spec.Binary.Command,
+			args:          spec.Binary.Args,
+			DrainRequired: DrainRequired{drainRequired: drainRequired},
+			timeout:       timeout,
+		}, nil
+	case spec.Systemctl != nil:
+		return &RunSystemctlAction{
+			unitName:      spec.Systemctl.Unit,
+			operation:     UnitOperation(spec.Systemctl.Operation),
+			DrainRequired: DrainRequired{drainRequired: drainRequired},
+			timeout:       timeout,
+		}, nil
+	default:
+		return nil, fmt.Errorf("file reboot policy entry has no action configured")
+	}
+}
@@ -0,0 +1,134 @@
+package daemon
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"os"
+	"os/exec"
+	"os/signal"
+	"sync"
+	"syscall"
+
+	"github.com/golang/glog"
+)
+
+// maxCapturedOutputBytes caps how much of a RunBinaryAction's stdout/stderr
+// is kept around for ActionResult; the full output is still streamed to
+// glog as it's produced.
+const maxCapturedOutputBytes = 64 * 1024
+
+// childReaper owns the single syscall.Wait4(-1, ...) loop for this process
+// and hands each terminated child's status to whichever RunBinaryAction.Run
+// call is waiting on that PID. Centralizing the reap here, rather than
+// letting exec.Cmd.Wait do it per-command, is what lets it also clean up
+// orphaned grandchildren (e.g. left behind by a reload hook) that never
+// belonged to any exec.Cmd we started, which matters on deployments where
+// the MCD runs as PID 1.
+type childReaper struct {
+	mu      sync.Mutex
+	waiters map[int]chan syscall.WaitStatus
+}
+
+var reaper = &childReaper{waiters: make(map[int]chan syscall.WaitStatus)}
+
+// start starts cmd and registers a channel to receive its exit status,
+// holding r.mu across both. A child can only be reaped by dispatch once it
+// exists, and dispatch takes the same lock to look up its waiter, so a
+// SIGCHLD for this child arriving the instant it exits cannot be dispatched
+// until start has finished registering the waiter: dispatch simply blocks on
+// r.mu until then, rather than finding no waiter and silently dropping the
+// exit status. Without this, a fast-exiting child (e.g. a one-line shell
+// command) could have its SIGCHLD reaped before its waiter was registered, leaving
+// nothing to ever signal the channel Run is about to block on.
+func (r *childReaper) start(cmd *exec.Cmd) (chan syscall.WaitStatus, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	ch := make(chan syscall.WaitStatus, 1)
+	r.waiters[cmd.Process.Pid] = ch
+	return ch, nil
+}
+
+func (r *childReaper) stopWaiting(pid int) {
+	r.mu.Lock()
+	delete(r.waiters, pid)
+	r.mu.Unlock()
+}
+
+func (r *childReaper) dispatch(pid int, ws syscall.WaitStatus) {
+	r.mu.Lock()
+	ch, ok := r.waiters[pid]
+	r.mu.Unlock()
+	if ok {
+		ch <- ws
+	}
+}
+
+func (r *childReaper) reapAll() {
+	for {
+		var ws syscall.WaitStatus
+		pid, err := syscall.Wait4(-1, &ws, syscall.WNOHANG, nil)
+		if err != nil || pid <= 0 {
+			if err != nil && err != syscall.ECHILD {
+				glog.Warningf("wait4 failed while reaping children: %v", err)
+			}
+			return
+		}
+		r.dispatch(pid, ws)
+	}
+}
+
+// StartChildReaper starts a goroutine that reaps every terminated child of
+// this process. It must be started once, early in the MCD's startup, before
+// any RunBinaryAction runs: on deployments where the MCD runs as PID 1,
+// unhandled SIGCHLD from orphaned grandchildren would otherwise leak
+// zombies forever.
+func StartChildReaper() {
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGCHLD)
+	go func() {
+		for range sigCh {
+			reaper.reapAll()
+		}
+	}()
+}
+
+// lineCapBuffer accumulates output up to a size cap; lines beyond the cap
+// are dropped from the buffer (though still streamed to glog by the caller)
+// so a chatty command can't make an ActionResult unboundedly large.
+type lineCapBuffer struct {
+	buf   bytes.Buffer
+	limit int
+}
+
+func (b *lineCapBuffer) writeLine(line string) {
+	if b.buf.Len() >= b.limit {
+		return
+	}
+	b.buf.WriteString(line)
+	b.buf.WriteByte('\n')
+}
+
+func (b *lineCapBuffer) String() string {
+	return b.buf.String()
+}
+
+// streamOutput copies r line by line into glog, under the given binary and
+// stream name, while also accumulating it into dst up to its cap. It
+// returns once r is exhausted, which for a pipe means the process has
+// closed that stream.
+func streamOutput(wg *sync.WaitGroup, r io.Reader, dst *lineCapBuffer, stream, binary string) {
+	defer wg.Done()
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		glog.Infof("%s[%s]: %s", binary, stream, line)
+		dst.writeLine(line)
+	}
+	if err := scanner.Err(); err != nil {
+		glog.Warningf("Error reading %s from %q: %v", stream, binary, err)
+	}
+}
@@ -0,0 +1,162 @@
+package daemon
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"time"
+
+	systemdDbus "github.com/coreos/go-systemd/dbus"
+	"github.com/golang/glog"
+)
+
+// unitJobTimeout bounds how long we wait for systemd to report that a
+// reload/restart job has finished before giving up and treating it as a
+// failed post update action.
+const unitJobTimeout = 2 * time.Minute
+
+// systemdUnitDir is where handleUnitsChanges writes the unit files systemd
+// picks up on daemon-reload.
+const systemdUnitDir = "/etc/systemd/system"
+
+// systemdUnitPath returns the on-disk path for a systemd unit named name.
+func systemdUnitPath(name string) string {
+	return filepath.Join(systemdUnitDir, name)
+}
+
+// dbusConnection lazily opens a private system-bus connection to systemd and
+// caches it so that every RunSystemctlAction in a single update pass can
+// share one connection instead of dialing dbus per unit.
+type dbusConnection struct {
+	conn *systemdDbus.Conn
+}
+
+func (d *dbusConnection) get() (*systemdDbus.Conn, error) {
+	if d.conn == nil {
+		conn, err := systemdDbus.NewSystemConnection()
+		if err != nil {
+			return nil, fmt.Errorf("failed to connect to systemd over dbus: %v", err)
+		}
+		d.conn = conn
+	}
+	return d.conn, nil
+}
+
+func (d *dbusConnection) close() {
+	if d.conn != nil {
+		d.conn.Close()
+		d.conn = nil
+	}
+}
+
+// reloadDaemon issues a systemd daemon-reload so that any unit files written
+// by handleUnitsChanges earlier in the same update pass (new drop-ins,
+// masked units, etc.) are picked up before we act on any of them.
+func (d *dbusConnection) reloadDaemon() error {
+	conn, err := d.get()
+	if err != nil {
+		return err
+	}
+	glog.Info("Reloading systemd daemon configuration")
+	return conn.Reload()
+}
+
+// resolveDependents looks up the units named in dependentUnits that are
+// currently loaded and confirms, via their Wants/Requires properties, that
+// they actually depend on unitName before agreeing to restart them
+// alongside it.
+func resolveDependents(conn *systemdDbus.Conn, unitName string, dependentUnits []string) []string {
+	if len(dependentUnits) == 0 {
+		return nil
+	}
+	loaded, err := conn.ListUnitsByPatterns([]string{"loaded"}, dependentUnits)
+	if err != nil {
+		glog.Warningf("Could not resolve dependent units for %q: %v", unitName, err)
+		return nil
+	}
+	dependents := make([]string, 0, len(loaded))
+	for _, unit := range loaded {
+		if unitWantsOrRequires(conn, unit.Name, unitName) {
+			dependents = append(dependents, unit.Name)
+		}
+	}
+	return dependents
+}
+
+func unitWantsOrRequires(conn *systemdDbus.Conn, unit, dependency string) bool {
+	for _, propertyName := range []string{"Wants", "Requires"} {
+		property, err := conn.GetUnitProperty(unit, propertyName)
+		if err != nil {
+			continue
+		}
+		names, ok := property.Value.Value().([]string)
+		if !ok {
+			continue
+		}
+		for _, name := range names {
+			if name == dependency {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (action *RunSystemctlAction) SetDbusConnection(conn *dbusConnection) {
+	action.dbus = conn
+}
+
+func (action RunSystemctlAction) Run(ctx context.Context) (ActionResult, error) {
+	if action.dbus == nil {
+		return ActionResult{}, fmt.Errorf("systemctl action for unit %q has no dbus connection set", action.unitName)
+	}
+	conn, err := action.dbus.get()
+	if err != nil {
+		return ActionResult{}, err
+	}
+
+	timeout := unitJobTimeout
+	if action.timeout > 0 {
+		timeout = action.timeout
+	}
+
+	start := time.Now()
+	units := append([]string{action.unitName}, resolveDependents(conn, action.unitName, action.dependentUnits)...)
+	var lastStatus string
+	for _, unit := range units {
+		status, err := runUnitOperation(ctx, conn, unit, action.operation, timeout)
+		lastStatus = status
+		if err != nil {
+			return ActionResult{Duration: time.Since(start), UnitJobStatus: lastStatus}, err
+		}
+	}
+	return ActionResult{Duration: time.Since(start), UnitJobStatus: lastStatus}, nil
+}
+
+func runUnitOperation(ctx context.Context, conn *systemdDbus.Conn, unit string, operation UnitOperation, timeout time.Duration) (string, error) {
+	glog.Infof("Running post update action: %s unit %q", operation, unit)
+	resultCh := make(chan string, 1)
+	var err error
+	switch operation {
+	case unitReload:
+		_, err = conn.ReloadUnit(unit, "replace", resultCh)
+	default:
+		_, err = conn.ReloadOrRestartUnit(unit, "replace", resultCh)
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to %s unit %q: %v", operation, unit, err)
+	}
+
+	select {
+	case result := <-resultCh:
+		if result != "done" {
+			return result, fmt.Errorf("%s of unit %q finished with result %q", operation, unit, result)
+		}
+		glog.Infof("Unit %q %s succeeded", unit, operation)
+		return result, nil
+	case <-ctx.Done():
+		return "", fmt.Errorf("%s of unit %q cancelled: %v", operation, unit, ctx.Err())
+	case <-time.After(timeout):
+		return "", fmt.Errorf("timed out waiting for %s of unit %q", operation, unit)
+	}
+}